@@ -0,0 +1,61 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+// Endpoint represents a single node participating in a hashring, i.e. a
+// remote-write receiver that can be forwarded series by the rest of the
+// ring.
+type Endpoint struct {
+	// Address is the HTTP address on which the endpoint accepts
+	// forwarded remote-write requests.
+	Address string `json:"address"`
+	// CapNProtoAddress is the address on which the endpoint accepts
+	// Cap'n Proto forwarded remote-write requests.
+	CapNProtoAddress string `json:"capnproto_address,omitempty"`
+	// AZ is the availability zone this endpoint lives in. When set across
+	// a hashring's endpoints, ketama spreads a section's replicas across
+	// as many distinct AZs as possible.
+	AZ string `json:"az,omitempty"`
+}
+
+// TenantMatcherType describes how a HashringConfig's tenant patterns are
+// matched against an incoming tenant.
+type TenantMatcherType string
+
+const (
+	// TenantMatcherTypeExact matches a tenant pattern only if it is
+	// exactly equal to the tenant. This is the default when
+	// TenantMatcherType is left empty.
+	TenantMatcherTypeExact TenantMatcherType = "exact"
+	// TenantMatcherGlob matches a tenant pattern as a shell glob against
+	// the tenant, as implemented by path/filepath.Match.
+	TenantMatcherGlob TenantMatcherType = "glob"
+)
+
+type tenantMatcher = TenantMatcherType
+
+// isExactMatcher reports whether mt selects the exact-match fast path.
+// Empty is treated as exact match so that hashring configs which never set
+// TenantMatcherType keep their historical exact-match behavior.
+func isExactMatcher(mt tenantMatcher) bool {
+	return mt == TenantMatcherTypeExact || mt == ""
+}
+
+// HashringConfig represents the configuration for a hashring, describing
+// which tenants it serves and which endpoints make up its ring.
+type HashringConfig struct {
+	Hashring          string            `json:"hashring,omitempty"`
+	Tenants           []string          `json:"tenants,omitempty"`
+	TenantMatcherType tenantMatcher     `json:"tenant_matcher_type,omitempty"`
+	Endpoints         []Endpoint        `json:"endpoints"`
+	Algorithm         HashringAlgorithm `json:"algorithm,omitempty"`
+	// LoadFactor overrides DefaultLoadFactor for this hashring when
+	// Algorithm is AlgorithmKetamaBounded, i.e. the multiplier applied to
+	// the ring's average per-endpoint load to get the load an endpoint
+	// may carry before GetN starts skipping it in favor of the next
+	// replica. Ignored, along with bounded-load tracking entirely, for
+	// any other algorithm. Left at its zero value, the ring falls back
+	// to DefaultLoadFactor.
+	LoadFactor float64 `json:"load_factor,omitempty"`
+}
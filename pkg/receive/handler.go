@@ -0,0 +1,102 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	goerrors "errors"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+// diffableHashring is implemented by the Hashring types that can compute a
+// reconciliation diff against a previous hashring of the same concrete type:
+// *ketamaHashring directly, and *multiHashring by diffing its inner
+// hashrings pairwise.
+type diffableHashring interface {
+	Diff(prev Hashring) map[Endpoint][]Endpoint
+}
+
+// Writer writes a single tenant's time series to one replica endpoint, e.g.
+// over the network to a remote endpoint or to local storage when endpoint is
+// this Handler's own address.
+type Writer interface {
+	Write(ctx context.Context, endpoint Endpoint, tenant string, ts *prompb.TimeSeries) error
+}
+
+// Handler forwards incoming remote-write requests for a tenant's time series
+// to every endpoint the active hashring assigns them to.
+type Handler struct {
+	mtx      sync.RWMutex
+	hashring Hashring
+	writer   Writer
+}
+
+// NewHandler returns a Handler that forwards writes through hashring via
+// writer.
+func NewHandler(hashring Hashring, writer Writer) *Handler {
+	return &Handler{hashring: hashring, writer: writer}
+}
+
+// Hashring swaps in newHashring as the hashring the Handler routes writes
+// through, returning a reconciliation diff against the hashring it replaces
+// so callers can pre-warm or drain the endpoints that gained or lost
+// ownership of series.
+func (h *Handler) Hashring(newHashring Hashring) map[Endpoint][]Endpoint {
+	h.mtx.Lock()
+	prev := h.hashring
+	h.hashring = newHashring
+	h.mtx.Unlock()
+
+	if prev == nil {
+		return nil
+	}
+	d, ok := newHashring.(diffableHashring)
+	if !ok {
+		return nil
+	}
+	return d.Diff(prev)
+}
+
+// forward writes ts for tenant to every endpoint that owns it, incrementing
+// each endpoint's tracked load before the write and releasing it again on
+// failure, so a bounded-load ring's view of an endpoint's load counts only
+// writes that endpoint actually accepted. Successful writes are never
+// released.
+func (h *Handler) forward(ctx context.Context, tenant string, ts *prompb.TimeSeries) error {
+	h.mtx.RLock()
+	hashring := h.hashring
+	h.mtx.RUnlock()
+
+	owners, err := hashring.Owners(tenant, ts)
+	if err != nil {
+		return errors.Wrap(err, "resolve replicas")
+	}
+
+	var errs []error
+	for _, endpoint := range owners {
+		hashring.Incr(endpoint)
+		if err := h.writer.Write(ctx, endpoint, tenant, ts); err != nil {
+			hashring.Decr(endpoint)
+			errs = append(errs, errors.Wrapf(err, "forward to %s", endpoint.Address))
+		}
+	}
+	// A failure on one replica must not stop the write from being
+	// attempted on the others; all failures are reported together.
+	return goerrors.Join(errs...)
+}
+
+// isLocalReplica reports whether endpoint is one of the replicas for tenant
+// and ts under the hashring currently in effect, i.e. whether this Handler
+// should write ts locally rather than only forwarding it on.
+func (h *Handler) isLocalReplica(endpoint Endpoint, tenant string, ts *prompb.TimeSeries) (bool, error) {
+	h.mtx.RLock()
+	hashring := h.hashring
+	h.mtx.RUnlock()
+
+	return hashring.IsOwnedBy(endpoint, tenant, ts)
+}
@@ -0,0 +1,192 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+type recordingWriter struct {
+	writes []Endpoint
+}
+
+func (w *recordingWriter) Write(_ context.Context, endpoint Endpoint, _ string, _ *prompb.TimeSeries) error {
+	w.writes = append(w.writes, endpoint)
+	return nil
+}
+
+type failingWriter struct {
+	recordingWriter
+	failAddress string
+}
+
+func (w *failingWriter) Write(ctx context.Context, endpoint Endpoint, tenant string, ts *prompb.TimeSeries) error {
+	if endpoint.Address == w.failAddress {
+		return errors.New("write failed")
+	}
+	return w.recordingWriter.Write(ctx, endpoint, tenant, ts)
+}
+
+func TestHandler_ForwardWritesToEveryOwner(t *testing.T) {
+	endpoints := []Endpoint{
+		mustEndpoint("node-1", "az1"),
+		mustEndpoint("node-2", "az2"),
+		mustEndpoint("node-3", "az3"),
+	}
+	ring, err := newKetamaBoundedHashring(endpoints, SectionsPerNode, 3, DefaultLoadFactor)
+	require.NoError(t, err)
+
+	writer := &recordingWriter{}
+	h := NewHandler(ring, writer)
+
+	ts := seriesFor(1)
+	require.NoError(t, h.forward(context.Background(), "tenant-a", ts))
+
+	owners, err := ring.Owners("tenant-a", ts)
+	require.NoError(t, err)
+	require.Len(t, writer.writes, len(owners))
+
+	for _, owner := range owners {
+		ok, err := h.isLocalReplica(owner, "tenant-a", ts)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	ok, err := h.isLocalReplica(mustEndpoint("node-4", "az1"), "tenant-a", ts)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestHandler_HashringSwapReturnsDiff(t *testing.T) {
+	prevEndpoints := []Endpoint{
+		mustEndpoint("node-1", ""),
+		mustEndpoint("node-2", ""),
+		mustEndpoint("node-3", ""),
+	}
+	prev, err := newKetamaHashring(prevEndpoints, SectionsPerNode, 1)
+	require.NoError(t, err)
+
+	h := &Handler{writer: &recordingWriter{}}
+	require.Nil(t, h.Hashring(prev), "the first hashring assignment has no predecessor to diff against")
+
+	curEndpoints := []Endpoint{
+		mustEndpoint("node-1", ""),
+		mustEndpoint("node-3", ""),
+		mustEndpoint("node-4", ""),
+	}
+	cur, err := newKetamaHashring(curEndpoints, SectionsPerNode, 1)
+	require.NoError(t, err)
+
+	diff := h.Hashring(cur)
+	require.NotEmpty(t, diff, "replacing the hashring should report the reconciliation diff against the previous one")
+}
+
+func TestHandler_HashringSwapReturnsDiff_MultiHashring(t *testing.T) {
+	// NewMultiHashring is the only exported constructor real callers use,
+	// so it always returns a *multiHashring, never a bare *ketamaHashring
+	// — the diff must still work through that wrapper.
+	prevCfg := []HashringConfig{{
+		Hashring:  "default",
+		Algorithm: AlgorithmKetama,
+		Endpoints: []Endpoint{
+			mustEndpoint("node-1", ""),
+			mustEndpoint("node-2", ""),
+			mustEndpoint("node-3", ""),
+		},
+	}}
+	prev, err := NewMultiHashring(AlgorithmKetama, 1, prevCfg)
+	require.NoError(t, err)
+
+	h := &Handler{writer: &recordingWriter{}}
+	require.Nil(t, h.Hashring(prev))
+
+	curCfg := []HashringConfig{{
+		Hashring:  "default",
+		Algorithm: AlgorithmKetama,
+		Endpoints: []Endpoint{
+			mustEndpoint("node-1", ""),
+			mustEndpoint("node-3", ""),
+			mustEndpoint("node-4", ""),
+		},
+	}}
+	cur, err := NewMultiHashring(AlgorithmKetama, 1, curCfg)
+	require.NoError(t, err)
+
+	diff := h.Hashring(cur)
+	require.NotEmpty(t, diff, "the multi-hashring wrapper must still surface a reconciliation diff")
+}
+
+func TestHandler_HashringSwapReturnsDiff_MultiHashringMatchesGroupsByName(t *testing.T) {
+	// Group "A" is entirely replaced by an unrelated group "X" at the same
+	// slice position, while group "B" simply gets a new endpoint. Diffing
+	// by position would wrongly compare A's old ring against X's new one
+	// and could also misread B's real change; diffing by name must skip
+	// A/X (no name match) and still catch B's change.
+	prevCfg := []HashringConfig{
+		{
+			Hashring:  "A",
+			Algorithm: AlgorithmKetama,
+			Endpoints: []Endpoint{mustEndpoint("a-1", ""), mustEndpoint("a-2", "")},
+		},
+		{
+			Hashring:  "B",
+			Algorithm: AlgorithmKetama,
+			Endpoints: []Endpoint{mustEndpoint("b-1", ""), mustEndpoint("b-2", "")},
+		},
+	}
+	prev, err := NewMultiHashring(AlgorithmKetama, 1, prevCfg)
+	require.NoError(t, err)
+
+	curCfg := []HashringConfig{
+		{
+			Hashring:  "X",
+			Algorithm: AlgorithmKetama,
+			Endpoints: []Endpoint{mustEndpoint("x-1", ""), mustEndpoint("x-2", "")},
+		},
+		{
+			Hashring:  "B",
+			Algorithm: AlgorithmKetama,
+			Endpoints: []Endpoint{mustEndpoint("b-1", ""), mustEndpoint("b-2", ""), mustEndpoint("b-3", "")},
+		},
+	}
+	cur, err := NewMultiHashring(AlgorithmKetama, 1, curCfg)
+	require.NoError(t, err)
+
+	h := &Handler{writer: &recordingWriter{}}
+	require.Nil(t, h.Hashring(prev))
+	diff := h.Hashring(cur)
+
+	for endpoint := range diff {
+		require.NotContains(t, []string{"x-1", "x-2"}, endpoint.Address, "group X has no predecessor by name and must not be diffed against group A")
+	}
+	require.Contains(t, diff, mustEndpoint("b-3", ""), "group B's own change, matched by name, must still be reported")
+}
+
+func TestHandler_ForwardContinuesAfterOneOwnerFails(t *testing.T) {
+	endpoints := []Endpoint{
+		mustEndpoint("node-1", "az1"),
+		mustEndpoint("node-2", "az2"),
+		mustEndpoint("node-3", "az3"),
+	}
+	ring, err := newKetamaHashring(endpoints, SectionsPerNode, 3)
+	require.NoError(t, err)
+
+	ts := seriesFor(1)
+	owners, err := ring.Owners("tenant-a", ts)
+	require.NoError(t, err)
+	require.Len(t, owners, 3)
+
+	writer := &failingWriter{failAddress: owners[0].Address}
+	h := NewHandler(ring, writer)
+
+	err = h.forward(context.Background(), "tenant-a", ts)
+	require.Error(t, err, "a failing replica must still be reported")
+	require.Len(t, writer.writes, len(owners)-1, "the remaining healthy owners must still receive the write")
+}
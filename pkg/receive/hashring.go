@@ -6,12 +6,14 @@ package receive
 import (
 	"fmt"
 	"math"
+	"net"
 	"path/filepath"
 	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/go-kit/log"
@@ -28,11 +30,30 @@ type HashringAlgorithm string
 const (
 	AlgorithmHashmod HashringAlgorithm = "hashmod"
 	AlgorithmKetama  HashringAlgorithm = "ketama"
+	// AlgorithmKetamaBounded is AlgorithmKetama with Google's "consistent
+	// hashing with bounded loads" layered on top, so that no single
+	// endpoint can be driven far past the ring's average load by a
+	// disproportionately busy tenant or series.
+	AlgorithmKetamaBounded HashringAlgorithm = "ketama_bounded"
 
 	// SectionsPerNode is the number of sections in the ring assigned to each node
 	// in the ketama hashring. A higher number yields a better series distribution,
 	// but also comes with a higher memory cost.
 	SectionsPerNode = 1000
+
+	// DefaultLoadFactor is the default multiplier applied to a bounded
+	// ketama ring's average per-endpoint load to get the maximum load an
+	// endpoint may carry before GetN starts skipping it in favor of the
+	// next replica.
+	DefaultLoadFactor = 1.25
+
+	// substituteWalkSectionsPerEndpoint bounds how many ring sections
+	// (substitute) walks forward per endpoint in the ring while looking
+	// for a stand-in for an overloaded replica. Consecutive sections are
+	// owned by essentially random distinct endpoints, so this many
+	// sections per endpoint is enough to encounter every endpoint several
+	// times over without the walk's cost scaling with SectionsPerNode.
+	substituteWalkSectionsPerEndpoint = 8
 )
 
 // insufficientNodesError is returned when a hashring does not
@@ -47,6 +68,19 @@ func (i *insufficientNodesError) Error() string {
 	return fmt.Sprintf("insufficient nodes; have %d, want %d", i.have, i.want)
 }
 
+// normalizeAddress strips an optional scheme and port from addr so that
+// endpoints configured with different formats (e.g. "http://node-1:19291"
+// vs "node-1") can still be reliably compared for ownership.
+func normalizeAddress(addr string) string {
+	if idx := strings.Index(addr, "://"); idx != -1 {
+		addr = addr[idx+3:]
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
 // Hashring finds the correct node to handle a given time series
 // for a specified tenant.
 // It returns the node and any error encountered.
@@ -56,6 +90,19 @@ type Hashring interface {
 	// Nodes returns a sorted slice of nodes that are in this hashring. Addresses could be duplicated
 	// if, for example, the same address is used for multiple tenants in the multi-hashring.
 	Nodes() []Endpoint
+	// Owners returns the full set of nodes (size equal to the replication factor)
+	// that should handle the given tenant and time series, in replica order.
+	Owners(tenant string, timeSeries *prompb.TimeSeries) ([]Endpoint, error)
+	// IsOwnedBy reports whether endpoint is one of the owners of the given
+	// tenant and time series.
+	IsOwnedBy(endpoint Endpoint, tenant string, timeSeries *prompb.TimeSeries) (bool, error)
+	// Incr records a successfully admitted series for endpoint. It is a
+	// no-op on hashrings that do not track per-endpoint load.
+	Incr(endpoint Endpoint)
+	// Decr releases a series previously recorded with Incr for endpoint,
+	// e.g. after a write failure or timeout. It is a no-op on hashrings
+	// that do not track per-endpoint load.
+	Decr(endpoint Endpoint)
 }
 
 // SingleNodeHashring always returns the same node.
@@ -76,10 +123,29 @@ func (s SingleNodeHashring) GetN(_ string, _ *prompb.TimeSeries, n uint64) (Endp
 	}, nil
 }
 
+// Owners implements the Hashring interface.
+func (s SingleNodeHashring) Owners(_ string, _ *prompb.TimeSeries) ([]Endpoint, error) {
+	return []Endpoint{{Address: string(s), CapNProtoAddress: string(s)}}, nil
+}
+
+// IsOwnedBy implements the Hashring interface.
+func (s SingleNodeHashring) IsOwnedBy(endpoint Endpoint, _ string, _ *prompb.TimeSeries) (bool, error) {
+	return normalizeAddress(endpoint.Address) == normalizeAddress(string(s)), nil
+}
+
+// Incr implements the Hashring interface. SingleNodeHashring never tracks load.
+func (s SingleNodeHashring) Incr(Endpoint) {}
+
+// Decr implements the Hashring interface. SingleNodeHashring never tracks load.
+func (s SingleNodeHashring) Decr(Endpoint) {}
+
 // simpleHashring represents a group of nodes handling write requests by hashmoding individual series.
-type simpleHashring []Endpoint
+type simpleHashring struct {
+	endpoints         []Endpoint
+	replicationFactor uint64
+}
 
-func newSimpleHashring(endpoints []Endpoint) (Hashring, error) {
+func newSimpleHashring(endpoints []Endpoint, replicationFactor uint64) (Hashring, error) {
 	for i := range endpoints {
 		if endpoints[i].AZ != "" {
 			return nil, errors.New("Hashmod algorithm does not support AZ aware hashring configuration. Either use Ketama or remove AZ configuration.")
@@ -89,11 +155,11 @@ func newSimpleHashring(endpoints []Endpoint) (Hashring, error) {
 		return strings.Compare(a.Address, b.Address)
 	})
 
-	return simpleHashring(endpoints), nil
+	return simpleHashring{endpoints: endpoints, replicationFactor: replicationFactor}, nil
 }
 
 func (s simpleHashring) Nodes() []Endpoint {
-	return s
+	return s.endpoints
 }
 
 // Get returns a target to handle the given tenant and time series.
@@ -103,13 +169,50 @@ func (s simpleHashring) Get(tenant string, ts *prompb.TimeSeries) (Endpoint, err
 
 // GetN returns the nth target to handle the given tenant and time series.
 func (s simpleHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (Endpoint, error) {
-	if n >= uint64(len(s)) {
-		return Endpoint{}, &insufficientNodesError{have: uint64(len(s)), want: n + 1}
+	if n >= uint64(len(s.endpoints)) {
+		return Endpoint{}, &insufficientNodesError{have: uint64(len(s.endpoints)), want: n + 1}
 	}
 
-	return s[(labelpb.HashWithPrefix(tenant, ts.Labels)+n)%uint64(len(s))], nil
+	return s.endpoints[(labelpb.HashWithPrefix(tenant, ts.Labels)+n)%uint64(len(s.endpoints))], nil
 }
 
+// Owners implements the Hashring interface.
+func (s simpleHashring) Owners(tenant string, ts *prompb.TimeSeries) ([]Endpoint, error) {
+	rf := s.replicationFactor
+	if rf == 0 || rf > uint64(len(s.endpoints)) {
+		rf = uint64(len(s.endpoints))
+	}
+	owners := make([]Endpoint, rf)
+	for n := uint64(0); n < rf; n++ {
+		endpoint, err := s.GetN(tenant, ts, n)
+		if err != nil {
+			return nil, err
+		}
+		owners[n] = endpoint
+	}
+	return owners, nil
+}
+
+// IsOwnedBy implements the Hashring interface.
+func (s simpleHashring) IsOwnedBy(endpoint Endpoint, tenant string, ts *prompb.TimeSeries) (bool, error) {
+	owners, err := s.Owners(tenant, ts)
+	if err != nil {
+		return false, err
+	}
+	for _, owner := range owners {
+		if normalizeAddress(owner.Address) == normalizeAddress(endpoint.Address) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Incr implements the Hashring interface. simpleHashring never tracks load.
+func (s simpleHashring) Incr(Endpoint) {}
+
+// Decr implements the Hashring interface. simpleHashring never tracks load.
+func (s simpleHashring) Decr(Endpoint) {}
+
 type section struct {
 	az            string
 	endpointIndex uint64
@@ -129,9 +232,32 @@ type ketamaHashring struct {
 	endpoints    []Endpoint
 	sections     sections
 	numEndpoints uint64
+
+	// bounded enables Google's "consistent hashing with bounded loads" on
+	// top of the ring: GetN will skip a replica whose load already
+	// exceeds loadFactor times the ring's average load, falling back to
+	// the precomputed replica only if every candidate is overloaded.
+	bounded    bool
+	loadFactor float64
+	// loads holds a running series count per endpoint, indexed the same
+	// way as endpoints. It is only maintained (via Incr/Decr) and
+	// consulted when bounded is true.
+	loads     []int64
+	totalLoad int64
 }
 
 func newKetamaHashring(endpoints []Endpoint, sectionsPerNode int, replicationFactor uint64) (*ketamaHashring, error) {
+	return newKetamaHashringInternal(endpoints, sectionsPerNode, replicationFactor, false, 0)
+}
+
+func newKetamaBoundedHashring(endpoints []Endpoint, sectionsPerNode int, replicationFactor uint64, loadFactor float64) (*ketamaHashring, error) {
+	if loadFactor <= 0 {
+		loadFactor = DefaultLoadFactor
+	}
+	return newKetamaHashringInternal(endpoints, sectionsPerNode, replicationFactor, true, loadFactor)
+}
+
+func newKetamaHashringInternal(endpoints []Endpoint, sectionsPerNode int, replicationFactor uint64, bounded bool, loadFactor float64) (*ketamaHashring, error) {
 	numSections := len(endpoints) * sectionsPerNode
 
 	if len(endpoints) < int(replicationFactor) {
@@ -164,6 +290,9 @@ func newKetamaHashring(endpoints []Endpoint, sectionsPerNode int, replicationFac
 		endpoints:    endpoints,
 		sections:     ringSections,
 		numEndpoints: uint64(len(endpoints)),
+		bounded:      bounded,
+		loadFactor:   loadFactor,
+		loads:        make([]int64, len(endpoints)),
 	}, nil
 }
 
@@ -209,29 +338,270 @@ func calculateSectionReplicas(ringSections sections, replicationFactor uint64, a
 	}
 }
 
-func (c ketamaHashring) Get(tenant string, ts *prompb.TimeSeries) (Endpoint, error) {
+func (c *ketamaHashring) Get(tenant string, ts *prompb.TimeSeries) (Endpoint, error) {
 	return c.GetN(tenant, ts, 0)
 }
 
-func (c ketamaHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (Endpoint, error) {
+func (c *ketamaHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (Endpoint, error) {
 	if n >= c.numEndpoints {
 		return Endpoint{}, &insufficientNodesError{have: c.numEndpoints, want: n + 1}
 	}
 
 	v := labelpb.HashWithPrefix(tenant, ts.Labels)
+	resolved := c.resolveSectionReplicas(c.sectionIndex(v))
+	return c.endpoints[resolved[n]], nil
+}
 
-	var i uint64
-	i = uint64(sort.Search(len(c.sections), func(i int) bool {
-		return c.sections[i].hash >= v
-	}))
+// resolveSectionReplicas returns the endpoint index each replica slot of
+// section i should resolve to. On a non-bounded ring this is simply the
+// section's precomputed replicas. On a bounded ring, any replica whose
+// endpoint is over the load limit is substituted, with a single claimed
+// set threaded across every slot so two slots can never be substituted
+// with the same endpoint.
+func (c *ketamaHashring) resolveSectionReplicas(i uint64) []uint64 {
+	replicas := c.sections[i].replicas
+	if !c.bounded {
+		return replicas
+	}
 
+	claimed := make(map[uint64]struct{}, len(replicas))
+	for _, rep := range replicas {
+		claimed[rep] = struct{}{}
+	}
+
+	resolved := make([]uint64, len(replicas))
+	for n, original := range replicas {
+		if c.withinLoadLimit(original) {
+			resolved[n] = original
+			continue
+		}
+		resolved[n] = c.substitute(i, original, claimed)
+	}
+	return resolved
+}
+
+// substitute finds a replacement for the overloaded endpoint original by
+// walking the ring forward from section i, skipping any endpoint already
+// in claimed (which substitute adds the winner to). To preserve the AZ
+// spread calculateSectionReplicas established, it prefers a candidate in
+// original's own AZ; only if that AZ has no endpoint with headroom does it
+// widen to any AZ, and only if no candidate turns up within the walk's
+// bound does it fall back to original itself, so a write is never rejected
+// outright. The walk is capped at substituteWalkSectionsPerEndpoint
+// sections per endpoint rather than sweeping the whole ring: it runs on
+// every overloaded replica slot from the GetN/Owners hot path, so its cost
+// must not scale with SectionsPerNode.
+func (c *ketamaHashring) substitute(i uint64, original uint64, claimed map[uint64]struct{}) uint64 {
+	originalAZ := c.endpoints[original].AZ
 	numSections := uint64(len(c.sections))
-	if i == numSections {
+
+	maxSteps := c.numEndpoints * substituteWalkSectionsPerEndpoint
+	if maxSteps >= numSections {
+		maxSteps = numSections - 1
+	}
+
+	var outOfAZCandidate uint64
+	haveOutOfAZCandidate := false
+
+	for step := uint64(1); step <= maxSteps; step++ {
+		candidate := c.sections[(i+step)%numSections].replicas[0]
+		if _, dup := claimed[candidate]; dup {
+			continue
+		}
+		if !c.withinLoadLimit(candidate) {
+			continue
+		}
+		if c.endpoints[candidate].AZ == originalAZ {
+			claimed[candidate] = struct{}{}
+			return candidate
+		}
+		if !haveOutOfAZCandidate {
+			outOfAZCandidate = candidate
+			haveOutOfAZCandidate = true
+		}
+	}
+	if haveOutOfAZCandidate {
+		claimed[outOfAZCandidate] = struct{}{}
+		return outOfAZCandidate
+	}
+	return original
+}
+
+// sectionIndex returns the index into c.sections of the ring section
+// responsible for hash v.
+func (c *ketamaHashring) sectionIndex(v uint64) uint64 {
+	i := uint64(sort.Search(len(c.sections), func(i int) bool {
+		return c.sections[i].hash >= v
+	}))
+	if i == uint64(len(c.sections)) {
 		i = 0
 	}
+	return i
+}
+
+// withinLoadLimit reports whether endpointIndex's current load is at or
+// below the ring's bounded-load ceiling.
+func (c *ketamaHashring) withinLoadLimit(endpointIndex uint64) bool {
+	return atomic.LoadInt64(&c.loads[endpointIndex]) <= c.maxLoad()
+}
 
-	endpointIndex := c.sections[i].replicas[n]
-	return c.endpoints[endpointIndex], nil
+// maxLoad returns the maximum load a single endpoint may carry, i.e. the
+// ring's average load multiplied by loadFactor, rounded up.
+func (c *ketamaHashring) maxLoad() int64 {
+	avg := float64(atomic.LoadInt64(&c.totalLoad)) / float64(c.numEndpoints)
+	return int64(math.Ceil(c.loadFactor * avg))
+}
+
+// Incr records a successfully admitted series for endpoint, increasing its
+// load. It is a no-op on hashrings that do not have bounded loads enabled.
+func (c *ketamaHashring) Incr(endpoint Endpoint) {
+	if !c.bounded {
+		return
+	}
+	idx, ok := c.endpointIndex(endpoint)
+	if !ok {
+		return
+	}
+	atomic.AddInt64(&c.loads[idx], 1)
+	atomic.AddInt64(&c.totalLoad, 1)
+}
+
+// Decr releases a series previously recorded with Incr for endpoint, e.g.
+// after a write failure or timeout. An endpoint's load never drops below
+// zero. It is a no-op on hashrings that do not have bounded loads enabled.
+func (c *ketamaHashring) Decr(endpoint Endpoint) {
+	if !c.bounded {
+		return
+	}
+	idx, ok := c.endpointIndex(endpoint)
+	if !ok {
+		return
+	}
+	for {
+		cur := atomic.LoadInt64(&c.loads[idx])
+		if cur <= 0 {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&c.loads[idx], cur, cur-1) {
+			atomic.AddInt64(&c.totalLoad, -1)
+			return
+		}
+	}
+}
+
+// endpointIndex returns the position of endpoint within c.endpoints.
+func (c *ketamaHashring) endpointIndex(endpoint Endpoint) (uint64, bool) {
+	for i, e := range c.endpoints {
+		if normalizeAddress(e.Address) == normalizeAddress(endpoint.Address) {
+			return uint64(i), true
+		}
+	}
+	return 0, false
+}
+
+// Owners implements the Hashring interface. It resolves every replica slot
+// of the hit section through the same shared-claimed-set substitution GetN
+// uses, so that, on a bounded-load ring, the returned set matches the
+// endpoints that would actually receive the write (with no duplicates)
+// rather than the section's static precomputed replicas.
+func (c *ketamaHashring) Owners(tenant string, ts *prompb.TimeSeries) ([]Endpoint, error) {
+	v := labelpb.HashWithPrefix(tenant, ts.Labels)
+	resolved := c.resolveSectionReplicas(c.sectionIndex(v))
+	owners := make([]Endpoint, len(resolved))
+	for i, endpointIndex := range resolved {
+		owners[i] = c.endpoints[endpointIndex]
+	}
+	return owners, nil
+}
+
+// IsOwnedBy implements the Hashring interface.
+func (c *ketamaHashring) IsOwnedBy(endpoint Endpoint, tenant string, ts *prompb.TimeSeries) (bool, error) {
+	owners, err := c.Owners(tenant, ts)
+	if err != nil {
+		return false, err
+	}
+	for _, owner := range owners {
+		if normalizeAddress(owner.Address) == normalizeAddress(endpoint.Address) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mergedHashBoundaries returns the sorted, deduplicated union of a's and b's
+// section hash points. Because every point in the result is the right edge
+// of a virtual node in at least one of the two rings, looking either ring up
+// at each point resolves the owner of the minimal sub-interval ending there
+// — which is exactly the granularity needed to compare ownership between two
+// rings section-by-section without missing a boundary that exists in only
+// one of them.
+func mergedHashBoundaries(a, b sections) []uint64 {
+	seen := make(map[uint64]struct{}, len(a)+len(b))
+	merged := make([]uint64, 0, len(a)+len(b))
+	for _, s := range a {
+		if _, ok := seen[s.hash]; !ok {
+			seen[s.hash] = struct{}{}
+			merged = append(merged, s.hash)
+		}
+	}
+	for _, s := range b {
+		if _, ok := seen[s.hash]; !ok {
+			seen[s.hash] = struct{}{}
+			merged = append(merged, s.hash)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i] < merged[j] })
+	return merged
+}
+
+// Diff returns, for each endpoint in c that newly owns some series, the set
+// of endpoints that owned those series according to prev; endpoints that
+// gained nothing are left out of the map. It only yields a
+// meaningful result when prev is also a ketama ring; any other Hashring
+// implementation has no notion of ownership by raw hash, so it produces an
+// empty diff. Ownership is compared at every sub-interval of the hash space
+// carved out by either ring's virtual nodes (not just c's), so a prev-ring
+// boundary that falls inside one of c's sections is never missed. Whole
+// replica sets (not just the primary) are compared per sub-interval, so a
+// series that moved between non-primary replicas is still picked up.
+func (c *ketamaHashring) Diff(prev Hashring) map[Endpoint][]Endpoint {
+	prevRing, ok := prev.(*ketamaHashring)
+	if !ok {
+		return map[Endpoint][]Endpoint{}
+	}
+
+	newOwners := make(map[Endpoint]map[Endpoint]struct{})
+	for _, b := range mergedHashBoundaries(c.sections, prevRing.sections) {
+		curReplicas := c.sections[c.sectionIndex(b)].replicas
+		prevReplicas := prevRing.sections[prevRing.sectionIndex(b)].replicas
+
+		prevOwners := make(map[string]Endpoint, len(prevReplicas))
+		for _, endpointIndex := range prevReplicas {
+			e := prevRing.endpoints[endpointIndex]
+			prevOwners[normalizeAddress(e.Address)] = e
+		}
+
+		for _, endpointIndex := range curReplicas {
+			curOwner := c.endpoints[endpointIndex]
+			if _, alreadyOwned := prevOwners[normalizeAddress(curOwner.Address)]; alreadyOwned {
+				continue
+			}
+			for _, prevOwner := range prevOwners {
+				if newOwners[curOwner] == nil {
+					newOwners[curOwner] = make(map[Endpoint]struct{})
+				}
+				newOwners[curOwner][prevOwner] = struct{}{}
+			}
+		}
+	}
+
+	diff := make(map[Endpoint][]Endpoint, len(newOwners))
+	for endpoint, owners := range newOwners {
+		for owner := range owners {
+			diff[endpoint] = append(diff[endpoint], owner)
+		}
+	}
+	return diff
 }
 
 type tenantSet map[string]tenantMatcher
@@ -267,9 +637,13 @@ func (t tenantSet) match(tenant string) (bool, error) {
 // Which hashring to use for a tenant is determined
 // by the tenants field of the hashring configuration.
 type multiHashring struct {
-	cache      map[string]Hashring
-	hashrings  []Hashring
-	tenantSets []tenantSet
+	cache     map[string]Hashring
+	hashrings []Hashring
+	// hashringNames holds each hashrings[i]'s HashringConfig.Hashring name,
+	// so that Diff can match up corresponding groups across two
+	// multiHashrings by name rather than by position.
+	hashringNames []string
+	tenantSets    []tenantSet
 
 	// We need a mutex to guard concurrent access
 	// to the cache map, as this is both written to
@@ -286,11 +660,72 @@ func (m *multiHashring) Get(tenant string, ts *prompb.TimeSeries) (Endpoint, err
 
 // GetN returns the nth target to handle the given tenant and time series.
 func (m *multiHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (Endpoint, error) {
+	h, err := m.hashringFor(tenant)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	return h.GetN(tenant, ts, n)
+}
+
+// Owners implements the Hashring interface by delegating to the inner
+// hashring selected for tenant.
+func (m *multiHashring) Owners(tenant string, ts *prompb.TimeSeries) ([]Endpoint, error) {
+	h, err := m.hashringFor(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return h.Owners(tenant, ts)
+}
+
+// IsOwnedBy implements the Hashring interface by delegating to the inner
+// hashring selected for tenant.
+func (m *multiHashring) IsOwnedBy(endpoint Endpoint, tenant string, ts *prompb.TimeSeries) (bool, error) {
+	h, err := m.hashringFor(tenant)
+	if err != nil {
+		return false, err
+	}
+	return h.IsOwnedBy(endpoint, tenant, ts)
+}
+
+// Incr implements the Hashring interface by forwarding to the first inner
+// hashring that lists endpoint among its nodes.
+func (m *multiHashring) Incr(endpoint Endpoint) {
+	if h := m.hashringContaining(endpoint); h != nil {
+		h.Incr(endpoint)
+	}
+}
+
+// Decr implements the Hashring interface by forwarding to the first inner
+// hashring that lists endpoint among its nodes.
+func (m *multiHashring) Decr(endpoint Endpoint) {
+	if h := m.hashringContaining(endpoint); h != nil {
+		h.Decr(endpoint)
+	}
+}
+
+// hashringContaining returns the first inner hashring, in configuration
+// order, that lists endpoint among its nodes, or nil if none does. An
+// endpoint shared by several inner hashrings is only ever matched to the
+// first of them.
+func (m *multiHashring) hashringContaining(endpoint Endpoint) Hashring {
+	for _, h := range m.hashrings {
+		for _, n := range h.Nodes() {
+			if normalizeAddress(n.Address) == normalizeAddress(endpoint.Address) {
+				return h
+			}
+		}
+	}
+	return nil
+}
+
+// hashringFor returns the inner hashring responsible for tenant, consulting
+// and populating m.cache as GetN has always done.
+func (m *multiHashring) hashringFor(tenant string) (Hashring, error) {
 	m.mu.RLock()
 	h, ok := m.cache[tenant]
 	m.mu.RUnlock()
 	if ok {
-		return h.GetN(tenant, ts, n)
+		return h, nil
 	}
 	var found bool
 
@@ -308,7 +743,7 @@ func (m *multiHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (En
 			} else {
 				var err error
 				if found, err = t.match(tenant); err != nil {
-					return Endpoint{}, err
+					return nil, err
 				}
 			}
 
@@ -318,16 +753,54 @@ func (m *multiHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (En
 			m.cache[tenant] = m.hashrings[i]
 			m.mu.Unlock()
 
-			return m.hashrings[i].GetN(tenant, ts, n)
+			return m.hashrings[i], nil
 		}
 	}
-	return Endpoint{}, errors.New("no matching hashring to handle tenant")
+	return nil, errors.New("no matching hashring to handle tenant")
 }
 
 func (m *multiHashring) Nodes() []Endpoint {
 	return m.nodes
 }
 
+// Diff mirrors ketamaHashring.Diff across every inner hashring making up the
+// multi-hashring, so that top-level callers (who only ever hold the
+// *multiHashring NewMultiHashring returns, never a bare *ketamaHashring) can
+// still reconcile a hashring config change. prev must also be a
+// *multiHashring; its groups are matched against m's by HashringConfig.Hashring
+// name (not position), so reordering, adding, or removing groups in a config
+// reload still diffs each group against its true predecessor rather than
+// whichever group happened to land at the same index. A group with no name
+// match in prev, or any inner hashring pair that isn't ketama-based,
+// contributes nothing to the result.
+func (m *multiHashring) Diff(prev Hashring) map[Endpoint][]Endpoint {
+	prevM, ok := prev.(*multiHashring)
+	if !ok {
+		return map[Endpoint][]Endpoint{}
+	}
+
+	prevByName := make(map[string]Hashring, len(prevM.hashrings))
+	for i, name := range prevM.hashringNames {
+		prevByName[name] = prevM.hashrings[i]
+	}
+
+	diff := make(map[Endpoint][]Endpoint)
+	for i, h := range m.hashrings {
+		prevH, ok := prevByName[m.hashringNames[i]]
+		if !ok {
+			continue
+		}
+		kr, ok := h.(*ketamaHashring)
+		if !ok {
+			continue
+		}
+		for endpoint, owners := range kr.Diff(prevH) {
+			diff[endpoint] = append(diff[endpoint], owners...)
+		}
+	}
+	return diff
+}
+
 // newMultiHashring creates a multi-tenant hashring for a given slice of
 // groups.
 // Which hashring to use for a tenant is determined
@@ -344,12 +817,13 @@ func NewMultiHashring(algorithm HashringAlgorithm, replicationFactor uint64, cfg
 		if h.Algorithm != "" {
 			activeAlgorithm = h.Algorithm
 		}
-		hashring, err = newHashring(activeAlgorithm, h.Endpoints, replicationFactor, h.Hashring, h.Tenants)
+		hashring, err = newHashring(activeAlgorithm, h.Endpoints, replicationFactor, h.Hashring, h.Tenants, h.LoadFactor)
 		if err != nil {
 			return nil, err
 		}
 		m.nodes = append(m.nodes, hashring.Nodes()...)
 		m.hashrings = append(m.hashrings, hashring)
+		m.hashringNames = append(m.hashringNames, h.Hashring)
 		var t map[string]tenantMatcher
 		if len(h.Tenants) != 0 {
 			t = make(map[string]tenantMatcher)
@@ -365,17 +839,23 @@ func NewMultiHashring(algorithm HashringAlgorithm, replicationFactor uint64, cfg
 	return m, nil
 }
 
-func newHashring(algorithm HashringAlgorithm, endpoints []Endpoint, replicationFactor uint64, hashring string, tenants []string) (Hashring, error) {
+// newHashring builds the Hashring for a single HashringConfig entry.
+// loadFactor is that entry's HashringConfig.LoadFactor; it is only consulted
+// for AlgorithmKetamaBounded, and a zero value there falls back to
+// DefaultLoadFactor.
+func newHashring(algorithm HashringAlgorithm, endpoints []Endpoint, replicationFactor uint64, hashring string, tenants []string, loadFactor float64) (Hashring, error) {
 	switch algorithm {
 	case AlgorithmHashmod:
-		return newSimpleHashring(endpoints)
+		return newSimpleHashring(endpoints, replicationFactor)
 	case AlgorithmKetama:
 		return newKetamaHashring(endpoints, SectionsPerNode, replicationFactor)
+	case AlgorithmKetamaBounded:
+		return newKetamaBoundedHashring(endpoints, SectionsPerNode, replicationFactor, loadFactor)
 	default:
 		l := log.NewNopLogger()
 		level.Warn(l).Log("msg", "Unrecognizable hashring algorithm. Fall back to hashmod algorithm.",
 			"hashring", hashring,
 			"tenants", tenants)
-		return newSimpleHashring(endpoints)
+		return newSimpleHashring(endpoints, replicationFactor)
 	}
 }
@@ -0,0 +1,439 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+func mustEndpoint(addr, az string) Endpoint {
+	return Endpoint{Address: addr, CapNProtoAddress: addr, AZ: az}
+}
+
+func seriesFor(i int) *prompb.TimeSeries {
+	return &prompb.TimeSeries{
+		Labels: []labelpb.ZLabel{
+			{Name: "__name__", Value: "test_metric"},
+			{Name: "series", Value: fmt.Sprintf("%d", i)},
+		},
+	}
+}
+
+func TestKetamaHashringBoundedLoad_UniformDistribution(t *testing.T) {
+	endpoints := []Endpoint{
+		mustEndpoint("node-1", ""),
+		mustEndpoint("node-2", ""),
+		mustEndpoint("node-3", ""),
+		mustEndpoint("node-4", ""),
+		mustEndpoint("node-5", ""),
+	}
+	ring, err := newKetamaBoundedHashring(endpoints, SectionsPerNode, 1, DefaultLoadFactor)
+	require.NoError(t, err)
+
+	const numSeries = 5000
+	counts := make(map[string]int, len(endpoints))
+	for i := 0; i < numSeries; i++ {
+		ts := seriesFor(i)
+		ep, err := ring.GetN("tenant-a", ts, 0)
+		require.NoError(t, err)
+		ring.Incr(ep)
+		counts[ep.Address]++
+	}
+	require.Len(t, counts, len(endpoints), "every endpoint should receive at least some series")
+
+	min, max := numSeries, 0
+	for _, c := range counts {
+		if c < min {
+			min = c
+		}
+		if c > max {
+			max = c
+		}
+	}
+	avg := numSeries / len(endpoints)
+	require.Less(t, max-min, avg, "with even load the ring should stay close to balanced")
+}
+
+func TestKetamaHashringBoundedLoad_SpillOverWhenHot(t *testing.T) {
+	endpoints := []Endpoint{
+		mustEndpoint("node-1", ""),
+		mustEndpoint("node-2", ""),
+		mustEndpoint("node-3", ""),
+	}
+	ring, err := newKetamaBoundedHashring(endpoints, SectionsPerNode, 1, DefaultLoadFactor)
+	require.NoError(t, err)
+
+	ts := seriesFor(1)
+	primary, err := ring.GetN("tenant-a", ts, 0)
+	require.NoError(t, err)
+
+	// Drive the primary's load far past the ring average so GetN has to
+	// spill the series over to a neighbor.
+	for i := 0; i < 100; i++ {
+		ring.Incr(primary)
+	}
+
+	spill, err := ring.GetN("tenant-a", ts, 0)
+	require.NoError(t, err)
+	require.NotEqual(t, primary.Address, spill.Address, "an overloaded primary should be skipped")
+
+	idx, ok := ring.endpointIndex(spill)
+	require.True(t, ok)
+	require.True(t, ring.withinLoadLimit(idx), "the node GetN spills to must itself be within the load limit")
+}
+
+func TestKetamaHashringBoundedLoad_NoDuplicateOwnersUnderMultiOverload(t *testing.T) {
+	endpoints := make([]Endpoint, 0, 8)
+	for i := 1; i <= 8; i++ {
+		endpoints = append(endpoints, mustEndpoint(fmt.Sprintf("node-%d", i), ""))
+	}
+	ring, err := newKetamaBoundedHashring(endpoints, SectionsPerNode, 3, DefaultLoadFactor)
+	require.NoError(t, err)
+
+	ts := seriesFor(1)
+	owners, err := ring.Owners("tenant-a", ts)
+	require.NoError(t, err)
+	require.Len(t, owners, 3)
+
+	// Overload two of the three replicas at once, the scenario where a
+	// naive per-slot substitution can hand out the same stand-in twice.
+	for _, owner := range owners[:2] {
+		for i := 0; i < 1000; i++ {
+			ring.Incr(owner)
+		}
+	}
+
+	resolved, err := ring.Owners("tenant-a", ts)
+	require.NoError(t, err)
+	require.Len(t, resolved, 3)
+
+	seen := make(map[string]struct{}, len(resolved))
+	for _, e := range resolved {
+		_, dup := seen[e.Address]
+		require.False(t, dup, "Owners returned duplicate endpoint %q", e.Address)
+		seen[e.Address] = struct{}{}
+	}
+}
+
+func TestKetamaHashringBoundedLoad_PreservesAZSpread(t *testing.T) {
+	endpoints := []Endpoint{
+		mustEndpoint("node-1", "az1"),
+		mustEndpoint("node-2", "az1"),
+		mustEndpoint("node-3", "az2"),
+		mustEndpoint("node-4", "az2"),
+		mustEndpoint("node-5", "az3"),
+		mustEndpoint("node-6", "az3"),
+	}
+	ring, err := newKetamaBoundedHashring(endpoints, SectionsPerNode, 3, DefaultLoadFactor)
+	require.NoError(t, err)
+
+	ts := seriesFor(1)
+	owners, err := ring.Owners("tenant-a", ts)
+	require.NoError(t, err)
+	require.Len(t, owners, 3)
+
+	azs := make(map[string]struct{}, 3)
+	for _, o := range owners {
+		azs[o.AZ] = struct{}{}
+	}
+	require.Len(t, azs, 3, "replicas should be spread across all three AZs")
+
+	hot := owners[0]
+	for i := 0; i < 1000; i++ {
+		ring.Incr(hot)
+	}
+
+	resolved, err := ring.Owners("tenant-a", ts)
+	require.NoError(t, err)
+	require.Len(t, resolved, 3)
+
+	resolvedAZs := make(map[string]struct{}, 3)
+	var replacement Endpoint
+	foundReplacement := false
+	for _, o := range resolved {
+		resolvedAZs[o.AZ] = struct{}{}
+		if o.AZ == hot.AZ && o.Address != hot.Address {
+			replacement = o
+			foundReplacement = true
+		}
+	}
+	require.Len(t, resolvedAZs, 3, "substitution must keep the replica set spread across all three AZs")
+	require.True(t, foundReplacement, "the overloaded replica should be substituted with another endpoint in its own AZ")
+	require.NotEqual(t, hot.Address, replacement.Address)
+}
+
+func TestKetamaHashringBoundedLoad_SubstituteWalkIsBoundedOnLargeRing(t *testing.T) {
+	endpoints := make([]Endpoint, 0, 50)
+	for i := 1; i <= 50; i++ {
+		endpoints = append(endpoints, mustEndpoint(fmt.Sprintf("node-%d", i), ""))
+	}
+	ring, err := newKetamaBoundedHashring(endpoints, SectionsPerNode, 1, DefaultLoadFactor)
+	require.NoError(t, err)
+
+	ts := seriesFor(1)
+	primary, err := ring.GetN("tenant-a", ts, 0)
+	require.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		ring.Incr(primary)
+	}
+
+	// A single hot endpoint among 50 must still find a substitute well
+	// within substituteWalkSectionsPerEndpoint sections per endpoint,
+	// i.e. the bounded walk must not need to fall back to the overloaded
+	// original.
+	spill, err := ring.GetN("tenant-a", ts, 0)
+	require.NoError(t, err)
+	require.NotEqual(t, primary.Address, spill.Address, "the bounded substitute walk should still find a replacement well under the full ring size")
+}
+
+func TestKetamaHashring_EndpointAddRemove(t *testing.T) {
+	base := []Endpoint{
+		mustEndpoint("node-1", ""),
+		mustEndpoint("node-2", ""),
+		mustEndpoint("node-3", ""),
+		mustEndpoint("node-4", ""),
+	}
+	ring, err := newKetamaHashring(base, SectionsPerNode, 1)
+	require.NoError(t, err)
+
+	added := append(append([]Endpoint{}, base...), mustEndpoint("node-5", ""))
+	ringAdded, err := newKetamaHashring(added, SectionsPerNode, 1)
+	require.NoError(t, err)
+
+	removed := base[:3]
+	ringRemoved, err := newKetamaHashring(removed, SectionsPerNode, 1)
+	require.NoError(t, err)
+
+	const numSeries = 2000
+	movedOnAdd := 0
+	for i := 0; i < numSeries; i++ {
+		ts := seriesFor(i)
+
+		before, err := ring.GetN("tenant-a", ts, 0)
+		require.NoError(t, err)
+
+		afterAdd, err := ringAdded.GetN("tenant-a", ts, 0)
+		require.NoError(t, err)
+		if afterAdd.Address != before.Address {
+			movedOnAdd++
+		}
+
+		afterRemove, err := ringRemoved.GetN("tenant-a", ts, 0)
+		require.NoError(t, err)
+		require.NotEqual(t, "node-4", afterRemove.Address, "a removed endpoint must never be returned")
+	}
+
+	// Consistent hashing promises minimal movement: growing from 4 to 5
+	// endpoints should reassign roughly a fifth of the keys, not all of them.
+	require.Less(t, movedOnAdd, numSeries/2)
+}
+
+func TestKetamaHashring_OwnersAZAware(t *testing.T) {
+	endpoints := []Endpoint{
+		mustEndpoint("node-1", "az1"),
+		mustEndpoint("node-2", "az2"),
+		mustEndpoint("node-3", "az3"),
+	}
+	ring, err := newKetamaHashring(endpoints, SectionsPerNode, 3)
+	require.NoError(t, err)
+
+	ts := seriesFor(1)
+	owners, err := ring.Owners("tenant-a", ts)
+	require.NoError(t, err)
+	require.Len(t, owners, 3)
+
+	azs := make(map[string]struct{}, 3)
+	for _, o := range owners {
+		azs[o.AZ] = struct{}{}
+	}
+	require.Len(t, azs, 3)
+
+	for _, o := range owners {
+		ok, err := ring.IsOwnedBy(o, "tenant-a", ts)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	ok, err := ring.IsOwnedBy(mustEndpoint("node-4", "az1"), "tenant-a", ts)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestMultiHashring_TenantRouting(t *testing.T) {
+	cfg := []HashringConfig{
+		{
+			Hashring:          "acme",
+			Tenants:           []string{"acme"},
+			TenantMatcherType: TenantMatcherTypeExact,
+			Endpoints: []Endpoint{
+				mustEndpoint("acme-1", ""),
+				mustEndpoint("acme-2", ""),
+			},
+		},
+		{
+			Hashring: "default",
+			Endpoints: []Endpoint{
+				mustEndpoint("default-1", ""),
+				mustEndpoint("default-2", ""),
+			},
+		},
+	}
+
+	ring, err := NewMultiHashring(AlgorithmHashmod, 1, cfg)
+	require.NoError(t, err)
+
+	ts := seriesFor(1)
+	owners, err := ring.Owners("acme", ts)
+	require.NoError(t, err)
+	require.Len(t, owners, 1)
+	require.Contains(t, []string{"acme-1", "acme-2"}, owners[0].Address)
+
+	ok, err := ring.IsOwnedBy(owners[0], "acme", ts)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = ring.IsOwnedBy(mustEndpoint("default-1", ""), "acme", ts)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	otherTS := seriesFor(1)
+	defaultOwners, err := ring.Owners("other-tenant", otherTS)
+	require.NoError(t, err)
+	require.Len(t, defaultOwners, 1)
+	require.Contains(t, []string{"default-1", "default-2"}, defaultOwners[0].Address)
+}
+
+func TestMultiHashring_KetamaBoundedLoadFactorFromConfig(t *testing.T) {
+	cfg := []HashringConfig{
+		{
+			Hashring:  "custom-factor",
+			Algorithm: AlgorithmKetamaBounded,
+			Endpoints: []Endpoint{
+				mustEndpoint("node-1", ""),
+				mustEndpoint("node-2", ""),
+			},
+			LoadFactor: 2.5,
+		},
+		{
+			Hashring:  "default-factor",
+			Algorithm: AlgorithmKetamaBounded,
+			Endpoints: []Endpoint{
+				mustEndpoint("node-3", ""),
+				mustEndpoint("node-4", ""),
+			},
+		},
+	}
+
+	ring, err := NewMultiHashring(AlgorithmKetamaBounded, 1, cfg)
+	require.NoError(t, err)
+	m, ok := ring.(*multiHashring)
+	require.True(t, ok)
+	require.Len(t, m.hashrings, 2)
+
+	custom, ok := m.hashrings[0].(*ketamaHashring)
+	require.True(t, ok)
+	require.Equal(t, 2.5, custom.loadFactor, "an explicit HashringConfig.LoadFactor must reach the underlying ring")
+
+	def, ok := m.hashrings[1].(*ketamaHashring)
+	require.True(t, ok)
+	require.Equal(t, DefaultLoadFactor, def.loadFactor, "an unset HashringConfig.LoadFactor must fall back to DefaultLoadFactor")
+}
+
+func TestKetamaHashringDiff(t *testing.T) {
+	prevEndpoints := []Endpoint{
+		mustEndpoint("node-1", ""),
+		mustEndpoint("node-2", ""),
+		mustEndpoint("node-3", ""),
+	}
+	prev, err := newKetamaHashring(prevEndpoints, SectionsPerNode, 2)
+	require.NoError(t, err)
+
+	// Replace node-2 with node-4, keep node-1 and node-3.
+	curEndpoints := []Endpoint{
+		mustEndpoint("node-1", ""),
+		mustEndpoint("node-3", ""),
+		mustEndpoint("node-4", ""),
+	}
+	cur, err := newKetamaHashring(curEndpoints, SectionsPerNode, 2)
+	require.NoError(t, err)
+
+	diff := cur.Diff(prev)
+	require.NotEmpty(t, diff, "a ring change should produce at least one reconciliation entry")
+
+	curAddrs := make(map[string]struct{}, len(curEndpoints))
+	for _, e := range curEndpoints {
+		curAddrs[e.Address] = struct{}{}
+	}
+	prevAddrs := make(map[string]struct{}, len(prevEndpoints))
+	for _, e := range prevEndpoints {
+		prevAddrs[e.Address] = struct{}{}
+	}
+
+	var node4Owners []Endpoint
+	for endpoint, owners := range diff {
+		_, isCurrent := curAddrs[endpoint.Address]
+		require.True(t, isCurrent, "Diff key %q must be a member of the current ring", endpoint.Address)
+		for _, owner := range owners {
+			_, wasPrevious := prevAddrs[owner.Address]
+			require.True(t, wasPrevious, "Diff value %q must be a member of the previous ring", owner.Address)
+		}
+		if endpoint.Address == "node-4" {
+			node4Owners = owners
+		}
+	}
+	require.NotEmpty(t, node4Owners, "the newly added endpoint should show up in the diff with donors to pull from")
+
+	require.Empty(t, cur.Diff(cur), "diffing a ring against itself must yield no reassignments")
+}
+
+func TestKetamaHashringDiff_CapturesBoundariesInsideCurrentSections(t *testing.T) {
+	// A large prev ring shrinking down to a handful of nodes packs many
+	// prev-ring boundaries inside each surviving current section's
+	// interval. The surviving sections' own right edges are owned by the
+	// same endpoint in both rings, so sampling prev only there would find
+	// no donors at all; the full boundary sweep must surface every one.
+	prevEndpoints := make([]Endpoint, 0, 20)
+	for i := 1; i <= 20; i++ {
+		prevEndpoints = append(prevEndpoints, mustEndpoint(fmt.Sprintf("node-%d", i), ""))
+	}
+	prev, err := newKetamaHashring(prevEndpoints, SectionsPerNode, 1)
+	require.NoError(t, err)
+
+	curEndpoints := []Endpoint{
+		mustEndpoint("node-1", ""),
+		mustEndpoint("node-2", ""),
+		mustEndpoint("node-3", ""),
+	}
+	cur, err := newKetamaHashring(curEndpoints, SectionsPerNode, 1)
+	require.NoError(t, err)
+
+	diff := cur.Diff(prev)
+	require.Len(t, diff, len(curEndpoints), "every surviving endpoint should appear as a diff key")
+
+	prevAddrs := make(map[string]struct{}, len(prevEndpoints))
+	for _, e := range prevEndpoints {
+		prevAddrs[e.Address] = struct{}{}
+	}
+
+	donors := make(map[string]struct{})
+	for endpoint, owners := range diff {
+		require.NotEmpty(t, owners, "endpoint %q should have at least one donor after a 20->3 shrink", endpoint.Address)
+		for _, owner := range owners {
+			_, wasPrevious := prevAddrs[owner.Address]
+			require.True(t, wasPrevious, "Diff value %q must be a member of the previous ring", owner.Address)
+			donors[owner.Address] = struct{}{}
+		}
+	}
+	// With only 3 endpoints left to absorb 20 endpoints' worth of ring
+	// space, the surviving nodes between them must have picked up series
+	// from more donors than there are surviving endpoints.
+	require.Greater(t, len(donors), 3, "a 20->3 shrink must pull from far more than one donor per surviving section")
+}